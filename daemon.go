@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// runDaemon turns runner into a long-running sync service: it runs once
+// immediately, then re-triggers runner.run on cfg.Schedule (a standard
+// cron expression) with up to cfg.ScheduleJitterSeconds of random delay,
+// and again as soon as any job with watch_poll_interval set sees a new
+// file appear in its ReadPath. runner.run already skips overlapping runs,
+// so the schedule and every watcher can trigger it freely without
+// coordinating with each other. It blocks until SIGINT or SIGTERM is
+// received, then stops scheduling new runs and waits for one already in
+// progress to finish before returning.
+func runDaemon(runner *syncRunner, cfg Config) error {
+	stop := make(chan struct{})
+	var watchers sync.WaitGroup
+
+	if cfg.Schedule != "" {
+		c := cron.New()
+		if _, err := c.AddFunc(cfg.Schedule, func() {
+			jitterSleep(cfg.ScheduleJitterSeconds)
+			runner.run()
+		}); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", cfg.Schedule, err)
+		}
+		c.Start()
+		defer func() { <-c.Stop().Done() }()
+		logger.Info("daemon: scheduled sync", "schedule", cfg.Schedule)
+	}
+
+	for _, job := range runner.jobs {
+		if job.WatchPollInterval == "" {
+			continue
+		}
+		interval, err := time.ParseDuration(job.WatchPollInterval)
+		if err != nil {
+			return fmt.Errorf("job %s: invalid watch_poll_interval %q: %v", job.Name, job.WatchPollInterval, err)
+		}
+		watchers.Add(1)
+		go func(job Job, interval time.Duration) {
+			defer watchers.Done()
+			watchJob(runner, job, interval, stop)
+		}(job, interval)
+		logger.Info("daemon: watching job for new files", "job", job.Name, "interval", interval.String())
+	}
+
+	runner.run()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	logger.Info("daemon: received signal, finishing in-flight run before exiting", "signal", sig.String())
+
+	close(stop)
+	watchers.Wait()
+	return nil
+}
+
+// jitterSleep sleeps a random duration in [0, maxSeconds) so that multiple
+// daemon replicas on the same schedule don't all hit the remote host at
+// exactly the same instant.
+func jitterSleep(maxSeconds int) {
+	if maxSeconds <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(rand.Intn(maxSeconds)) * time.Second)
+}
+
+// watchJob polls job's ReadPath every interval and triggers runner.run as
+// soon as it sees a file name it hasn't seen on a previous poll, until
+// stop is closed.
+func watchJob(runner *syncRunner, job Job, interval time.Duration, stop <-chan struct{}) {
+	seen := make(map[string]struct{})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sc, err := runner.pool.sftpClient(job)
+			if err != nil {
+				logger.Error("watch failed", "job", job.Name, "error", err)
+				continue
+			}
+			files, err := listSFTPFiles(*sc, job.ReadPath)
+			if err != nil {
+				logger.Error("watch failed", "job", job.Name, "error", err)
+				continue
+			}
+
+			current := make(map[string]struct{}, len(files))
+			newFile := false
+			for _, file := range files {
+				current[file.Name()] = struct{}{}
+				if _, ok := seen[file.Name()]; !ok {
+					newFile = true
+				}
+			}
+			seen = current
+
+			if newFile {
+				logger.Debug("watch detected new files, triggering sync", "job", job.Name)
+				runner.run()
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	s3afero "github.com/fclairamb/afero-s3"
+	"github.com/spf13/afero"
+)
+
+// DestinationConfig selects and configures the backend downloaded files are
+// written to. Type defaults to "local" (the current on-disk behavior).
+type DestinationConfig struct {
+	Type   string `yaml:"type"`
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+	Region string `yaml:"region"`
+}
+
+// Destination abstracts the filesystem downloaded files are archived to, so
+// downloadRemoteFile can stream a remote sftp file straight into local disk,
+// an afero in-memory fs (tests), or object storage without a local
+// intermediary.
+type Destination interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldname, newname string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+// buildDestination resolves a job's destination.type into a Destination.
+func buildDestination(job Job) (Destination, error) {
+	switch job.Destination.Type {
+	case "", "local":
+		return &localAferoDestination{aferoDestination{fs: afero.NewOsFs()}}, nil
+	case "memory":
+		return &localAferoDestination{aferoDestination{fs: afero.NewMemMapFs()}}, nil
+	case "s3":
+		return newS3Destination(job.Destination)
+	case "gcs":
+		return newGCSDestination(job.Destination)
+	case "azureblob":
+		return newAzureBlobDestination(job.Destination)
+	default:
+		return nil, fmt.Errorf("unknown destination.type %q", job.Destination.Type)
+	}
+}
+
+// aferoDestination adapts an afero.Fs (local disk, in-memory, or S3) to
+// Destination.
+type aferoDestination struct {
+	fs afero.Fs
+}
+
+func (d *aferoDestination) Create(name string) (io.WriteCloser, error) {
+	return d.fs.Create(name)
+}
+
+func (d *aferoDestination) Open(name string) (io.ReadCloser, error) {
+	return d.fs.Open(name)
+}
+
+func (d *aferoDestination) MkdirAll(path string, perm os.FileMode) error {
+	return d.fs.MkdirAll(path, perm)
+}
+
+func (d *aferoDestination) Rename(oldname, newname string) error {
+	return d.fs.Rename(oldname, newname)
+}
+
+func (d *aferoDestination) Stat(name string) (os.FileInfo, error) {
+	return d.fs.Stat(name)
+}
+
+// localAferoDestination is an aferoDestination that also supports
+// random-access writes, satisfying randomAccessDestination. Only the local
+// disk and in-memory backends embed this: the S3 backend is afero-backed
+// too, but S3 objects don't support WriteAt, so it stays a plain
+// aferoDestination and downloads fall back to the sequential path.
+type localAferoDestination struct {
+	aferoDestination
+}
+
+// OpenForWrite opens name for random-access writes without truncating any
+// existing content, so chunked downloads can resume a partial ".part" file.
+func (d *localAferoDestination) OpenForWrite(name string) (writerAtCloser, error) {
+	return d.fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// Remove deletes name, used to clean up a chunk download's completion
+// sidecar file once the download finishes successfully.
+func (d *localAferoDestination) Remove(name string) error {
+	return d.fs.Remove(name)
+}
+
+func newS3Destination(cfg DestinationConfig) (Destination, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("destination.bucket is required for destination.type \"s3\"")
+	}
+	fs, err := s3afero.NewFs(cfg.Bucket, cfg.Region, cfg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure S3 destination: %v", err)
+	}
+	return &aferoDestination{fs: fs}, nil
+}
+
+// gcsDestination streams directly into a GCS bucket. Object storage has no
+// real directories, so MkdirAll is a no-op, and Rename copies then deletes
+// since GCS objects cannot be renamed in place.
+type gcsDestination struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func newGCSDestination(cfg DestinationConfig) (Destination, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("destination.bucket is required for destination.type \"gcs\"")
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gcs client: %v", err)
+	}
+	return &gcsDestination{bucket: client.Bucket(cfg.Bucket), prefix: cfg.Prefix}, nil
+}
+
+func (d *gcsDestination) object(name string) *storage.ObjectHandle {
+	return d.bucket.Object(filepath.Join(d.prefix, name))
+}
+
+func (d *gcsDestination) Create(name string) (io.WriteCloser, error) {
+	return d.object(name).NewWriter(context.Background()), nil
+}
+
+func (d *gcsDestination) Open(name string) (io.ReadCloser, error) {
+	return d.object(name).NewReader(context.Background())
+}
+
+func (d *gcsDestination) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (d *gcsDestination) Rename(oldname, newname string) error {
+	ctx := context.Background()
+	src := d.object(oldname)
+	dst := d.object(newname)
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		return fmt.Errorf("unable to copy gcs object %s to %s: %v", oldname, newname, err)
+	}
+	return src.Delete(ctx)
+}
+
+func (d *gcsDestination) Stat(name string) (os.FileInfo, error) {
+	attrs, err := d.object(name).Attrs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return gcsFileInfo{attrs}, nil
+}
+
+type gcsFileInfo struct {
+	attrs *storage.ObjectAttrs
+}
+
+func (i gcsFileInfo) Name() string       { return filepath.Base(i.attrs.Name) }
+func (i gcsFileInfo) Size() int64        { return i.attrs.Size }
+func (i gcsFileInfo) Mode() os.FileMode  { return 0644 }
+func (i gcsFileInfo) ModTime() time.Time { return i.attrs.Updated }
+func (i gcsFileInfo) IsDir() bool        { return false }
+func (i gcsFileInfo) Sys() interface{}   { return i.attrs }
+
+// azureBlobDestination streams directly into an Azure Blob Storage
+// container. As with gcsDestination, there are no real directories and
+// renaming is implemented as copy-then-delete.
+type azureBlobDestination struct {
+	container azblob.ContainerURL
+	prefix    string
+}
+
+func newAzureBlobDestination(cfg DestinationConfig) (Destination, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("destination.bucket (container name) is required for destination.type \"azureblob\"")
+	}
+	accountName := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	accountKey := os.Getenv("AZURE_STORAGE_KEY")
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure azure blob credentials: %v", err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	containerURL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, cfg.Bucket))
+	if err != nil {
+		return nil, fmt.Errorf("unable to build azure blob container url: %v", err)
+	}
+	return &azureBlobDestination{container: azblob.NewContainerURL(*containerURL, pipeline), prefix: cfg.Prefix}, nil
+}
+
+func (d *azureBlobDestination) blockBlob(name string) azblob.BlockBlobURL {
+	return d.container.NewBlockBlobURL(filepath.Join(d.prefix, name))
+}
+
+func (d *azureBlobDestination) Create(name string) (io.WriteCloser, error) {
+	return newAzureBlobWriter(d.blockBlob(name)), nil
+}
+
+func (d *azureBlobDestination) Open(name string) (io.ReadCloser, error) {
+	ctx := context.Background()
+	resp, err := d.blockBlob(name).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (d *azureBlobDestination) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (d *azureBlobDestination) Rename(oldname, newname string) error {
+	ctx := context.Background()
+	src := d.blockBlob(oldname)
+	dst := d.blockBlob(newname)
+	if _, err := dst.StartCopyFromURL(ctx, src.URL(), nil, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil); err != nil {
+		return fmt.Errorf("unable to copy azure blob %s to %s: %v", oldname, newname, err)
+	}
+	_, err := src.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return err
+}
+
+func (d *azureBlobDestination) Stat(name string) (os.FileInfo, error) {
+	props, err := d.blockBlob(name).GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return azureBlobFileInfo{name: name, size: props.ContentLength(), modTime: props.LastModified()}, nil
+}
+
+type azureBlobFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i azureBlobFileInfo) Name() string       { return filepath.Base(i.name) }
+func (i azureBlobFileInfo) Size() int64        { return i.size }
+func (i azureBlobFileInfo) Mode() os.FileMode  { return 0644 }
+func (i azureBlobFileInfo) ModTime() time.Time { return i.modTime }
+func (i azureBlobFileInfo) IsDir() bool        { return false }
+func (i azureBlobFileInfo) Sys() interface{}   { return nil }
+
+// azureBlobWriter buffers writes and uploads them as a single block blob on
+// Close, matching the io.WriteCloser shape downloadRemoteFile needs.
+type azureBlobWriter struct {
+	blob azblob.BlockBlobURL
+	buf  []byte
+}
+
+func newAzureBlobWriter(blob azblob.BlockBlobURL) *azureBlobWriter {
+	return &azureBlobWriter{blob: blob}
+}
+
+func (w *azureBlobWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *azureBlobWriter) Close() error {
+	_, err := azblob.UploadBufferToBlockBlob(context.Background(), w.buf, w.blob, azblob.UploadToBlockBlobOptions{})
+	return err
+}
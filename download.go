@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	defaultChunkSizeBytes         = 32 * 1024
+	defaultDownloadWorkersPerFile = 4
+	defaultMaxDownloadRetries     = 5
+	initialRetryBackoff           = 200 * time.Millisecond
+)
+
+// downloadOptions tunes how a single file is downloaded: how large each
+// parallel chunk is, how many chunks are in flight at once, and how many
+// times a chunk is retried after a transient error.
+type downloadOptions struct {
+	chunkSize  int64
+	workers    int
+	maxRetries int
+}
+
+// writerAtCloser is what a chunked download writes into: random-access
+// writes so out-of-order chunks land at the right offset.
+type writerAtCloser interface {
+	io.WriterAt
+	io.Closer
+}
+
+// randomAccessDestination is implemented by destinations (local disk,
+// in-memory) that support opening a file for random-access writes, which is
+// what resumable, parallel chunked downloads require. Object-storage
+// destinations (S3, GCS, Azure Blob) only support sequential uploads, so
+// they fall back to downloadRemoteFileSequential instead.
+type randomAccessDestination interface {
+	Destination
+	OpenForWrite(name string) (writerAtCloser, error)
+	Remove(name string) error
+}
+
+// downloadRemoteFile downloads remoteReadFile into localFile and returns
+// its SHA-256. When dst supports random-access writes it downloads in
+// parallel chunks with resume support via a "<localFile>.part" file;
+// otherwise it falls back to a single sequential copy. verify requests an
+// extra checksum read-back after the transfer; what it catches depends on
+// the path (see downloadRemoteFileSequential and downloadRemoteFileResumable).
+func downloadRemoteFile(sc sftp.Client, dst Destination, remoteReadFile, localFile string, opts downloadOptions, verify bool) (sha256sum string, err error) {
+	if rad, ok := dst.(randomAccessDestination); ok {
+		return downloadRemoteFileResumable(sc, rad, remoteReadFile, localFile, opts, verify)
+	}
+	return downloadRemoteFileSequential(sc, dst, remoteReadFile, localFile, verify)
+}
+
+// downloadRemoteFileSequential is the plain single-threaded copy used for
+// destinations that cannot support random-access writes. Its hash is taken
+// from the same stream that is written to dst, so when verify is set the
+// destination read-back only confirms the write landed intact — it can't
+// catch corruption already present in the source read, unlike
+// downloadRemoteFileResumable's verify.
+func downloadRemoteFileSequential(sc sftp.Client, dst Destination, remoteReadFile, localFile string, verify bool) (sha256sum string, err error) {
+	srcFile, err := sc.OpenFile(remoteReadFile, os.O_RDONLY)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open remote file: %v\n", err)
+	}
+	defer srcFile.Close()
+
+	if err = dst.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		return "", fmt.Errorf("Unable to create destination directory: %v\n", err)
+	}
+	dstFile, err := dst.Create(localFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open destination file: %v\n", err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			dstFile.Close()
+		}
+	}()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(dstFile, hasher), srcFile); err != nil {
+		return "", fmt.Errorf("Unable to copy remote file: %v\n", err)
+	}
+	sha256sum = hex.EncodeToString(hasher.Sum(nil))
+
+	if err = dstFile.Close(); err != nil {
+		return "", fmt.Errorf("Unable to finalize destination file: %v\n", err)
+	}
+	closed = true
+
+	if verify {
+		if err := verifyDownload(dst, localFile, sha256sum); err != nil {
+			return "", fmt.Errorf("verification failed for %s: %v", localFile, err)
+		}
+	}
+
+	logger.Debug("finished download", "local_path", localFile)
+	return sha256sum, nil
+}
+
+// downloadRemoteFileResumable downloads remoteReadFile in parallel chunks,
+// writing each directly to its offset in "<localFile>.part" via WriteAt. A
+// "<localFile>.part.chunks" sidecar records which chunks have landed, one
+// byte per chunk index; since chunks complete out of order across workers,
+// the .part file's size alone can't tell a resumed run which chunks are
+// actually present (a later chunk can land before an earlier one). On
+// success the .part file is renamed to localFile and the sidecar removed.
+//
+// The returned SHA-256 is read back from the assembled local file, which is
+// all the state store needs and costs only a local read. verify additionally
+// re-reads remoteReadFile from the source to compare against it — a real
+// independent check, but a second full transfer, so it only runs when the
+// caller actually asked for verification.
+func downloadRemoteFileResumable(sc sftp.Client, dst randomAccessDestination, remoteReadFile, localFile string, opts downloadOptions, verify bool) (sha256sum string, err error) {
+	if err = dst.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		return "", fmt.Errorf("Unable to create destination directory: %v\n", err)
+	}
+
+	srcFile, err := sc.OpenFile(remoteReadFile, os.O_RDONLY)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open remote file: %v\n", err)
+	}
+	defer srcFile.Close()
+
+	srcInfo, err := sc.Stat(remoteReadFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to stat remote file: %v\n", err)
+	}
+	size := srcInfo.Size()
+
+	partFile := localFile + ".part"
+	chunksFile := partFile + ".chunks"
+	completed, valid, err := loadCompletedChunks(dst, chunksFile, opts.chunkSize)
+	if err != nil {
+		return "", err
+	}
+	if !valid {
+		// No usable completion record for this chunk size: a previous
+		// attempt may have used a different chunk_size_bytes, under which
+		// the same byte offsets mean different chunk indexes. Rather than
+		// risk misreading stale markers, drop any partial state and
+		// re-download the file from scratch.
+		if err := dst.Remove(partFile); err != nil {
+			logger.Debug("no existing part file to remove", "path", partFile, "error", err)
+		}
+		if err := dst.Remove(chunksFile); err != nil {
+			logger.Debug("no existing chunk completion file to remove", "path", chunksFile, "error", err)
+		}
+	} else if len(completed) > 0 {
+		logger.Debug("resuming partial download", "part_path", partFile, "completed_chunks", len(completed))
+	}
+
+	dstFile, err := dst.OpenForWrite(partFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open destination file: %v\n", err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			dstFile.Close()
+		}
+	}()
+
+	chunksDst, err := dst.OpenForWrite(chunksFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open chunk completion file: %v\n", err)
+	}
+	chunksClosed := false
+	defer func() {
+		if !chunksClosed {
+			chunksDst.Close()
+		}
+	}()
+	if !valid {
+		if err := writeChunkHeader(chunksDst, opts.chunkSize); err != nil {
+			return "", err
+		}
+	}
+
+	if err = downloadChunks(srcFile, dstFile, chunksDst, completed, size, opts); err != nil {
+		return "", err
+	}
+
+	if err = dstFile.Close(); err != nil {
+		return "", fmt.Errorf("Unable to finalize destination file: %v\n", err)
+	}
+	closed = true
+	if err = chunksDst.Close(); err != nil {
+		return "", fmt.Errorf("Unable to finalize chunk completion file: %v\n", err)
+	}
+	chunksClosed = true
+
+	if err = dst.Rename(partFile, localFile); err != nil {
+		return "", fmt.Errorf("Unable to rename %s to %s: %v\n", partFile, localFile, err)
+	}
+	if err = dst.Remove(chunksFile); err != nil {
+		logger.Warn("unable to remove chunk completion file", "path", chunksFile, "error", err)
+	}
+
+	sha256sum, err = checksumFile(dst, localFile)
+	if err != nil {
+		return "", err
+	}
+
+	if verify {
+		sourceSHA256, err := hashRemoteFile(sc, remoteReadFile)
+		if err != nil {
+			return "", err
+		}
+		if sourceSHA256 != sha256sum {
+			return "", fmt.Errorf("verification failed for %s: checksum mismatch: got %s, want %s", localFile, sha256sum, sourceSHA256)
+		}
+	}
+
+	logger.Debug("finished download", "local_path", localFile)
+	return sha256sum, nil
+}
+
+type fileChunk struct {
+	index         int64
+	start, length int64
+}
+
+// chunkHeaderSize is the width, in bytes, of the chunkSize header that
+// chunksFile is prefixed with, so a resumed run can tell whether its
+// completion markers were written under the same chunk_size_bytes it's
+// about to use.
+const chunkHeaderSize = 8
+
+// writeChunkHeader stamps chunksDst with the chunk size this run is using,
+// so a later resume can detect a chunk_size_bytes change and discard the
+// completion markers instead of misreading them against new boundaries.
+func writeChunkHeader(chunksDst writerAtCloser, chunkSize int64) error {
+	var header [chunkHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(chunkSize))
+	if _, err := chunksDst.WriteAt(header[:], 0); err != nil {
+		return fmt.Errorf("unable to write chunk completion header: %v", err)
+	}
+	return nil
+}
+
+// loadCompletedChunks reads chunksFile back from dst: its header records
+// the chunk size it was written under, and the rest is one completion byte
+// per chunk index (1 meaning done). valid is false when there's no sidecar
+// yet, it's too short to contain a header, or its header doesn't match
+// chunkSize — in all of those cases the caller must not trust completed and
+// should start the download over rather than misread stale markers.
+func loadCompletedChunks(dst randomAccessDestination, chunksFile string, chunkSize int64) (completed map[int64]bool, valid bool, err error) {
+	r, err := dst.Open(chunksFile)
+	if err != nil {
+		return nil, false, nil
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to read chunk completion file: %v\n", err)
+	}
+	if len(data) < chunkHeaderSize {
+		return nil, false, nil
+	}
+	if int64(binary.BigEndian.Uint64(data[:chunkHeaderSize])) != chunkSize {
+		return nil, false, nil
+	}
+
+	body := data[chunkHeaderSize:]
+	completed = make(map[int64]bool, len(body))
+	for i, b := range body {
+		if b == 1 {
+			completed[int64(i)] = true
+		}
+	}
+	return completed, true, nil
+}
+
+// downloadChunks fans a bounded pool of workers out over [0, size) of
+// srcFile, skipping chunks already marked done in completed, with each
+// worker pulling chunks off a shared channel, writing them into dstFile at
+// their own offset, and marking them done in chunksDst.
+func downloadChunks(srcFile *sftp.File, dstFile, chunksDst writerAtCloser, completed map[int64]bool, size int64, opts downloadOptions) error {
+	var chunks []fileChunk
+	for start, index := int64(0), int64(0); start < size; start, index = start+opts.chunkSize, index+1 {
+		if completed[index] {
+			continue
+		}
+		length := opts.chunkSize
+		if start+length > size {
+			length = size - start
+		}
+		chunks = append(chunks, fileChunk{index, start, length})
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	chunkCh := make(chan fileChunk)
+	errCh := make(chan error, 1)
+	var feedErr error
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunkCh {
+				if err := downloadChunkWithRetry(srcFile, dstFile, chunksDst, c, opts.maxRetries); err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, c := range chunks {
+		select {
+		case chunkCh <- c:
+		case feedErr = <-errCh:
+			break feed
+		}
+	}
+	close(chunkCh)
+	wg.Wait()
+
+	if feedErr != nil {
+		return feedErr
+	}
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+// downloadChunkWithRetry reads one chunk via ReadAt and writes it via
+// WriteAt, retrying with exponential backoff on transient read errors such
+// as io.ErrUnexpectedEOF or a dropped connection. Once the chunk's bytes are
+// written it marks the chunk's index done in chunksDst, so a resumed run
+// can tell this chunk apart from one that never landed.
+func downloadChunkWithRetry(srcFile *sftp.File, dstFile, chunksDst writerAtCloser, c fileChunk, maxRetries int) error {
+	buf := make([]byte, c.length)
+	backoff := initialRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		n, err := srcFile.ReadAt(buf, c.start)
+		if err != nil && err != io.EOF {
+			if attempt >= maxRetries {
+				return fmt.Errorf("unable to read chunk at offset %d after %d attempts: %v", c.start, attempt+1, err)
+			}
+			logger.Warn("transient error reading chunk, retrying", "offset", c.start, "attempt", attempt+1, "max_attempts", maxRetries+1, "error", err)
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+
+		if _, err := dstFile.WriteAt(buf[:n], c.start); err != nil {
+			return fmt.Errorf("unable to write chunk at offset %d: %v", c.start, err)
+		}
+		if _, err := chunksDst.WriteAt([]byte{1}, chunkHeaderSize+c.index); err != nil {
+			return fmt.Errorf("unable to mark chunk at offset %d complete: %v", c.start, err)
+		}
+		return nil
+	}
+}
+
+// verifyDownload reads localFile back from the destination and compares its
+// SHA-256 against the checksum computed during download.
+func verifyDownload(dst Destination, localFile, expectedSHA256 string) error {
+	got, err := checksumFile(dst, localFile)
+	if err != nil {
+		return err
+	}
+	if got != expectedSHA256 {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", got, expectedSHA256)
+	}
+	return nil
+}
+
+// hashRemoteFile reopens remoteReadFile on the source sftp connection and
+// returns its SHA-256, read sequentially and independently of however the
+// chunked download fetched it. downloadRemoteFileResumable uses this as the
+// "expected" checksum and compares it with the checksum read back from the
+// destination, so verification checks against the source rather than
+// against the destination copy itself.
+func hashRemoteFile(sc sftp.Client, remoteReadFile string) (string, error) {
+	f, err := sc.OpenFile(remoteReadFile, os.O_RDONLY)
+	if err != nil {
+		return "", fmt.Errorf("Unable to reopen remote file for checksum: %v\n", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("Unable to read remote file for checksum: %v\n", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// checksumFile reads name back from dst and returns its SHA-256.
+func checksumFile(dst Destination, name string) (string, error) {
+	r, err := dst.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("Unable to reopen destination file for checksum: %v\n", err)
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", fmt.Errorf("Unable to read destination file for checksum: %v\n", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
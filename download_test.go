@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func newMemDestination() *localAferoDestination {
+	return &localAferoDestination{aferoDestination{fs: afero.NewMemMapFs()}}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	dst := newMemDestination()
+	w, err := dst.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want, err := checksumFile(dst, "file.txt")
+	if err != nil {
+		t.Fatalf("checksumFile: %v", err)
+	}
+
+	if err := verifyDownload(dst, "file.txt", want); err != nil {
+		t.Errorf("verifyDownload with matching checksum: %v", err)
+	}
+	if err := verifyDownload(dst, "file.txt", "0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Error("expected verifyDownload to fail on a checksum mismatch")
+	}
+}
+
+func TestLoadCompletedChunks(t *testing.T) {
+	dst := newMemDestination()
+
+	completed, valid, err := loadCompletedChunks(dst, "missing.part.chunks", 32*1024)
+	if err != nil {
+		t.Fatalf("loadCompletedChunks on missing file: %v", err)
+	}
+	if valid {
+		t.Fatal("expected a missing file to be reported as not valid for resume")
+	}
+	if len(completed) != 0 {
+		t.Fatalf("expected no completed chunks for a missing file, got %v", completed)
+	}
+
+	const chunkSize = 32 * 1024
+	w, err := dst.OpenForWrite("present.part.chunks")
+	if err != nil {
+		t.Fatalf("OpenForWrite: %v", err)
+	}
+	if err := writeChunkHeader(w, chunkSize); err != nil {
+		t.Fatalf("writeChunkHeader: %v", err)
+	}
+	if _, err := w.WriteAt([]byte{1}, chunkHeaderSize+0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if _, err := w.WriteAt([]byte{1}, chunkHeaderSize+2); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if _, err := w.WriteAt([]byte{0}, chunkHeaderSize+1); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	completed, valid, err = loadCompletedChunks(dst, "present.part.chunks", chunkSize)
+	if err != nil {
+		t.Fatalf("loadCompletedChunks: %v", err)
+	}
+	if !valid {
+		t.Fatal("expected a matching chunk size header to be valid for resume")
+	}
+	want := map[int64]bool{0: true, 2: true}
+	if len(completed) != len(want) {
+		t.Fatalf("loadCompletedChunks = %v, want %v", completed, want)
+	}
+	for idx := range want {
+		if !completed[idx] {
+			t.Errorf("expected chunk %d to be marked completed", idx)
+		}
+	}
+	if completed[1] {
+		t.Error("chunk 1 was written as 0 and should not be marked completed")
+	}
+
+	if _, valid, err := loadCompletedChunks(dst, "present.part.chunks", chunkSize*2); err != nil {
+		t.Fatalf("loadCompletedChunks with different chunk size: %v", err)
+	} else if valid {
+		t.Error("expected a chunk size mismatch to be reported as not valid for resume")
+	}
+}
@@ -1,39 +1,145 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultSFTPPort           = "22"
+	defaultConcurrency        = 4
+	defaultMaxSessionsPerConn = 4
+)
+
+type AuthConfig struct {
+	Method              string `yaml:"method"`
+	KeyFile             string `yaml:"keyfile"`
+	KeyPassphraseEnvVar string `yaml:"keypassphrase_envvar"`
+}
+
+// Job describes a single host/directory pair to sync: where to read new
+// files from, where to archive them remotely once downloaded, and where to
+// put them locally.
+type Job struct {
+	Name                   string            `yaml:"name"`
+	ConnectionStringEnvVar string            `yaml:"connectionstringenvvar"`
+	ReadPath               string            `yaml:"readpath"`
+	ArchivedPath           string            `yaml:"archivepath"`
+	DownloadPath           string            `yaml:"downloadpath"`
+	IncludeGlob            string            `yaml:"includeglob"`
+	ExcludeGlob            string            `yaml:"excludeglob"`
+	Auth                   AuthConfig        `yaml:"auth"`
+	KnownHostsPath         string            `yaml:"known_hosts_path"`
+	StrictHostKeyChecking  bool              `yaml:"strict_host_key_checking"`
+	MaxSessionsPerConn     int               `yaml:"max_sessions_per_conn"`
+	Destination            DestinationConfig `yaml:"destination"`
+	StatePath              string            `yaml:"state_path"`
+	VerifyDownload         bool              `yaml:"verify_download"`
+	Archive                ArchiveConfig     `yaml:"archive"`
+	ChunkSizeBytes         int64             `yaml:"chunk_size_bytes"`
+	DownloadWorkersPerFile int               `yaml:"download_workers_per_file"`
+	MaxDownloadRetries     int               `yaml:"max_download_retries"`
+	WatchPollInterval      string            `yaml:"watch_poll_interval"`
+}
+
+// statePath returns the job's configured state store path, defaulting to a
+// hidden file alongside its downloaded files.
+func (j Job) statePath() string {
+	if j.StatePath != "" {
+		return j.StatePath
+	}
+	return filepath.Join(j.DownloadPath, ".gosftpsync-state.json")
+}
+
+// downloadOptions returns the chunked-download tuning for this job, falling
+// back to the package defaults for anything left unset.
+func (j Job) downloadOptions() downloadOptions {
+	opts := downloadOptions{
+		chunkSize:  j.ChunkSizeBytes,
+		workers:    j.DownloadWorkersPerFile,
+		maxRetries: j.MaxDownloadRetries,
+	}
+	if opts.chunkSize <= 0 {
+		opts.chunkSize = defaultChunkSizeBytes
+	}
+	if opts.workers <= 0 {
+		opts.workers = defaultDownloadWorkersPerFile
+	}
+	if opts.maxRetries <= 0 {
+		opts.maxRetries = defaultMaxDownloadRetries
+	}
+	return opts
+}
+
+// ArchiveConfig controls whether processed files are moved to ArchivedPath
+// on the remote after downloading. Enabled defaults to true so existing
+// configs keep the current archive-on-download behavior; set it to false
+// for read-only SFTP drops where the state store is the only record of
+// what has already been synced.
+type ArchiveConfig struct {
+	Enabled *bool `yaml:"enabled"`
+}
+
+func (c ArchiveConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// Config is the top-level YAML document. Schedule and ScheduleJitterSeconds
+// only apply in --daemon mode, where they drive the cron-based re-run of
+// every job. Metrics is likewise opt-in: it only starts an HTTP server when
+// listen_addr is set.
 type Config struct {
-	SFTPConfig struct {
-		ArchivedPath           string `yaml:"archivepath"`
-		DownloadPath           string `yaml:"downloadpath"`
-		ConnectionStringEnvVar string `yaml:"connectionstringenvvar"`
-		ReadPath               string `yaml:"readpath"`
-		Verbose                bool   `yaml:"verbose"`
-	} `yaml:"sftpconfig"`
+	Verbose               bool          `yaml:"verbose"`
+	Concurrency           int           `yaml:"concurrency"`
+	Schedule              string        `yaml:"schedule"`
+	ScheduleJitterSeconds int           `yaml:"schedule_jitter_seconds"`
+	Metrics               MetricsConfig `yaml:"metrics"`
+	Jobs                  []Job         `yaml:"jobs"`
 }
 
-var iLog *log.Logger
-var verbose bool
+// logger is the process-wide structured logger, writing JSON lines to the
+// log file given on the command line. It is initialized in main once the
+// log file and config (for the verbose->debug level) are available.
+var logger *slog.Logger
+
+// fatal logs msg at error level with args and exits, replacing the old
+// iLog.Fatalf calls now that slog has no built-in fatal level.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
 
 func main() {
+	concurrency := flag.Int("concurrency", 0, "number of files to download concurrently across jobs (default: config value, falling back to 4)")
+	jobsFilter := flag.String("jobs", "", "comma-separated list of job names to run (default: all jobs in config)")
+	daemon := flag.Bool("daemon", false, "keep running: re-sync on the config's cron schedule and/or as soon as a watched job sees new files, instead of exiting after one pass")
+	flag.Parse()
+
 	// validate arguments
-	if len(os.Args) != 3 {
+	args := flag.Args()
+	if len(args) != 2 {
 		log.Fatal("Please provide args -> gosftpsync \"<configfilepath>\" \"<loggilepath\"")
 	}
 	// setup logger
-	LOGFILE := os.Args[2]
+	LOGFILE := args[1]
 	f, err := os.OpenFile(LOGFILE, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Println(err)
@@ -41,230 +147,566 @@ func main() {
 	}
 	defer f.Close()
 
-	LstdFlags := log.Ldate | log.Lshortfile
-	iLog = log.New(f, "gosftpsync ", LstdFlags)
-	iLog.SetFlags(log.Lshortfile | log.LstdFlags)
+	logger = slog.New(slog.NewJSONHandler(f, nil))
 
 	var cfg Config
-	err = readConfigFile(&cfg, os.Args[1])
-	verbose = cfg.SFTPConfig.Verbose
+	if err := readConfigFile(&cfg, args[0]); err != nil {
+		fatal("failed reading config", "path", args[0], "error", err)
+	}
+	if cfg.Verbose {
+		logger = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	logger.Debug("read config", "path", args[0])
 
-	if err != nil {
-		iLog.Fatalf("Failed reading config from %s. Err: %+v\n", os.Args[1], err)
+	jobs := filterJobs(cfg.Jobs, *jobsFilter)
+	if len(jobs) == 0 {
+		fatal("no jobs to run")
 	}
 
-	if verbose {
-		iLog.Println("VERBOSE: post read config")
+	workers := *concurrency
+	if workers <= 0 {
+		workers = cfg.Concurrency
+	}
+	if workers <= 0 {
+		workers = defaultConcurrency
 	}
 
-	// Package starts
-	start := time.Now()
-	iLog.Printf("Starting gosftpsync at %v\n", start)
+	if cfg.Metrics.ListenAddr != "" {
+		serveMetrics(cfg.Metrics.ListenAddr)
+	}
 
-	if verbose {
-		iLog.Println("VERBOSE: Loading environment variable")
+	runner := newSyncRunner(cfg, jobs, workers)
+	defer runner.close()
+
+	if *daemon {
+		if err := runDaemon(runner, cfg); err != nil {
+			fatal("daemon failed", "error", err)
+		}
+		return
 	}
 
-	rawurl := os.Getenv(cfg.SFTPConfig.ConnectionStringEnvVar)
-	if rawurl == "" {
-		iLog.Fatalf("Can't find environment variable %s\n", cfg.SFTPConfig.ConnectionStringEnvVar)
+	runner.run()
+}
+
+// syncRunner holds everything a sync pass needs across repeated
+// invocations: the connection pool (so --daemon mode reuses SSH sessions
+// between runs) and a guard against overlapping runs.
+type syncRunner struct {
+	cfg     Config
+	jobs    []Job
+	workers int
+	pool    *connPool
+	running int32
+}
+
+func newSyncRunner(cfg Config, jobs []Job, workers int) *syncRunner {
+	return &syncRunner{cfg: cfg, jobs: jobs, workers: workers, pool: newConnPool(jobs)}
+}
+
+func (r *syncRunner) close() {
+	r.pool.closeAll()
+}
+
+// run executes one full sync pass across every job. If a previous pass is
+// still running it logs and returns immediately instead of overlapping
+// with it, so a slow run never piles up behind a cron tick or file-watch
+// trigger.
+func (r *syncRunner) run() {
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		logger.Info("skipping run: previous run is still in progress")
+		return
 	}
+	defer atomic.StoreInt32(&r.running, 0)
 
-	if verbose {
-		iLog.Println("VERBOSE: Parsing url")
+	start := time.Now()
+	logger.Info("starting sync", "jobs", len(r.jobs), "concurrency", r.workers)
+
+	tasks := make(chan downloadTask)
+	var downloaded int64
+
+	// jobErrors tracks, per job, whether anything went wrong this run
+	// (enqueueing or downloading), so lastSuccessfulRunTimestamp is only
+	// set for jobs that actually completed cleanly.
+	jobErrors := make(map[string]*int32, len(r.jobs))
+	for _, job := range r.jobs {
+		var n int32
+		jobErrors[job.Name] = &n
+	}
+
+	var workersWG sync.WaitGroup
+	for i := 0; i < r.workers; i++ {
+		workersWG.Add(1)
+		go func() {
+			defer workersWG.Done()
+			for t := range tasks {
+				if err := processDownloadTask(t); err != nil {
+					atomic.AddInt32(jobErrors[t.job.Name], 1)
+					filesFailedTotal.WithLabelValues(t.job.Name).Inc()
+					logger.Error("failed to sync file", "job", t.job.Name, "remote_path", t.fileInfo.Name(), "error", err)
+					continue
+				}
+				atomic.AddInt64(&downloaded, 1)
+			}
+		}()
+	}
+
+	var jobsWG sync.WaitGroup
+	for _, job := range r.jobs {
+		jobsWG.Add(1)
+		go func(job Job) {
+			defer jobsWG.Done()
+			if err := enqueueJob(r.pool, job, tasks); err != nil {
+				atomic.AddInt32(jobErrors[job.Name], 1)
+				logger.Error("job failed", "job", job.Name, "error", err)
+			}
+		}(job)
+	}
+
+	jobsWG.Wait()
+	close(tasks)
+	workersWG.Wait()
+
+	for _, job := range r.jobs {
+		if atomic.LoadInt32(jobErrors[job.Name]) == 0 {
+			lastSuccessfulRunTimestamp.WithLabelValues(job.Name).SetToCurrentTime()
+		}
 	}
 
-	parsedURL, err := url.Parse(rawurl)
+	duration := time.Since(start)
+	logger.Info("sync complete", "downloaded", atomic.LoadInt64(&downloaded), "jobs", len(r.jobs), "duration_ms", duration.Milliseconds())
+}
+
+func readConfigFile(config *Config, configPath string) error {
+	f, err := os.Open(configPath)
 	if err != nil {
-		iLog.Fatalf("Parse Url error %s\n", err)
+		return err
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	if err := decoder.Decode(&config); err != nil {
+		return err
 	}
+	return nil
+}
 
-	// get connection details
-	if verbose {
-		iLog.Println("VERBOSE: Collecting parsed data")
+// filterJobs restricts jobs to the comma-separated names in filter. An empty
+// filter runs every job in the config.
+func filterJobs(jobs []Job, filter string) []Job {
+	if filter == "" {
+		return jobs
+	}
+	wanted := make(map[string]struct{})
+	for _, name := range strings.Split(filter, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = struct{}{}
+		}
 	}
-	user := parsedURL.User.Username()
-	password, passwordExists := parsedURL.User.Password()
-	host := parsedURL.Host
-	port := 22
-	if !passwordExists {
-		iLog.Fatal("Missing password in SFTPTOGO_URL environment variable")
+	var filtered []Job
+	for _, job := range jobs {
+		if _, ok := wanted[job.Name]; ok {
+			filtered = append(filtered, job)
+		}
 	}
+	return filtered
+}
 
-	// Configuring the ssh client
-	if verbose {
-		iLog.Println("VERBOSE: Configuring ssh client")
+// matchesFileFilters reports whether name passes a job's optional
+// includeglob/excludeglob filters.
+func matchesFileFilters(name, includeGlob, excludeGlob string) (bool, error) {
+	if includeGlob != "" {
+		matched, err := filepath.Match(includeGlob, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid includeglob %q: %v", includeGlob, err)
+		}
+		if !matched {
+			return false, nil
+		}
 	}
-	var auths []ssh.AuthMethod
-	auths = append(auths, ssh.Password(password))
-	config := ssh.ClientConfig{
-		User:            user,
-		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	if excludeGlob != "" {
+		matched, err := filepath.Match(excludeGlob, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid excludeglob %q: %v", excludeGlob, err)
+		}
+		if matched {
+			return false, nil
+		}
 	}
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := ssh.Dial("tcp", addr, &config)
+	return true, nil
+}
+
+// downloadTask is one file queued for download, bound to the job and sftp
+// session that discovered it.
+type downloadTask struct {
+	job      Job
+	sc       *sftp.Client
+	dst      Destination
+	store    *stateStore
+	fileInfo fs.FileInfo
+}
+
+// enqueueJob connects to a job's host (reusing a pooled connection when
+// another job already targets it), lists ReadPath, skips files the state
+// store already has a matching (name, size, mtime) record for, and pushes
+// one downloadTask per remaining file onto tasks.
+func enqueueJob(pool *connPool, job Job, tasks chan<- downloadTask) error {
+	sc, err := pool.sftpClient(job)
 	if err != nil {
-		iLog.Fatalf("Failed to connecto to [%s]: %v\n", addr, err)
-		os.Exit(1)
+		return err
 	}
-	defer conn.Close()
 
-	// Create new SFTP client
-	if verbose {
-		iLog.Println("VERBOSE: Configuring sftp client")
-	}
-	sc, err := sftp.NewClient(conn)
+	dst, err := buildDestination(job)
 	if err != nil {
-		iLog.Fatalf("Unable to start SFTP subsystem: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("error configuring destination: %v", err)
 	}
-	defer sc.Close()
 
-	// list Processed files
-	if verbose {
-		iLog.Println("VERBOSE: Listing processed sftp files")
+	store, err := openStateStore(job.statePath())
+	if err != nil {
+		return fmt.Errorf("error opening state store: %v", err)
 	}
-	processedSFTPFiles, err := listSFTPFiles(*sc, cfg.SFTPConfig.ReadPath)
+
+	logger.Debug("listing files", "job", job.Name)
+	processedSFTPFiles, err := listSFTPFiles(*sc, job.ReadPath)
 	if err != nil {
-		iLog.Fatalf("Error listing processed sftp files. Err: %v\n", err)
+		return fmt.Errorf("error listing processed sftp files: %v", err)
 	}
+	filesListedTotal.WithLabelValues(job.Name).Add(float64(len(processedSFTPFiles)))
 
-	if verbose {
-		iLog.Printf("VERBOSE: Finished Listing %d processed sftp files", len(processedSFTPFiles))
+	var filesToDownload int
+	for _, file := range processedSFTPFiles {
+		matched, err := matchesFileFilters(file.Name(), job.IncludeGlob, job.ExcludeGlob)
+		if err != nil {
+			return fmt.Errorf("error filtering files: %v", err)
+		}
+		if !matched {
+			continue
+		}
+		if !store.needsDownload(file.Name(), file.Size(), file.ModTime()) {
+			continue
+		}
+		filesToDownload++
+		tasks <- downloadTask{job: job, sc: sc, dst: dst, store: store, fileInfo: file}
 	}
-	archivedSFTPFiles, err := listSFTPFiles(*sc, cfg.SFTPConfig.ArchivedPath)
+
+	logger.Info("found files to download", "job", job.Name, "count", filesToDownload)
+	return nil
+}
+
+// processDownloadTask downloads a single queued file (verifying its checksum
+// when verify_download is set; see downloadRemoteFile for what each
+// download path checks), records it in the job's state store, and archives
+// the remote file unless archiving is disabled. Workers call this
+// concurrently, across jobs, from
+// the shared task channel.
+func processDownloadTask(t downloadTask) error {
+	fileName := t.fileInfo.Name()
+	remoteReadFile := fmt.Sprintf("%s/%s", t.job.ReadPath, fileName)
+	localFile := fmt.Sprintf("%s/%s", t.job.DownloadPath, fileName)
+
+	start := time.Now()
+	sha256sum, err := downloadRemoteFile(*t.sc, t.dst, remoteReadFile, localFile, t.job.downloadOptions(), t.job.VerifyDownload)
 	if err != nil {
-		iLog.Fatalf("Error listing archived sftp files. Err: %s\n", err)
+		return err
 	}
+	duration := time.Since(start)
 
-	if verbose {
-		iLog.Printf("VERBOSE: Finished Listing %d archived sftp files", len(archivedSFTPFiles))
+	record := FileRecord{Name: fileName, Size: t.fileInfo.Size(), ModTime: t.fileInfo.ModTime(), SHA256: sha256sum}
+	if err := t.store.put(record); err != nil {
+		return fmt.Errorf("unable to record %s in state store: %v", fileName, err)
 	}
 
-	if verbose {
-		iLog.Println("VERBOSE: Getting diff files")
+	// Only count and log the download as done once it has also passed
+	// verification and been recorded in the state store, so the metrics
+	// can't show a file as both downloaded and failed.
+	downloadDurationSeconds.WithLabelValues(t.job.Name).Observe(duration.Seconds())
+	downloadSizeBytes.WithLabelValues(t.job.Name).Observe(float64(t.fileInfo.Size()))
+	filesDownloadedTotal.WithLabelValues(t.job.Name).Inc()
+	logger.Info("downloaded file", "job", t.job.Name, "remote_path", remoteReadFile, "bytes", t.fileInfo.Size(), "duration_ms", duration.Milliseconds())
+
+	if !t.job.Archive.enabled() {
+		return nil
 	}
-	filesToDownload := getDiffFileNames(processedSFTPFiles, archivedSFTPFiles)
-	iLog.Printf("Found %v new files. Downloading\n", len(filesToDownload))
-	if verbose {
-		iLog.Println("VERBOSE: starting to download files")
+	if err := archiveRemoteFile(*t.sc, fmt.Sprintf("%s/%s", t.job.ArchivedPath, fileName), remoteReadFile); err != nil {
+		return err
 	}
-	err = downloadFiles(*sc, filesToDownload, cfg.SFTPConfig.ReadPath, cfg.SFTPConfig.ArchivedPath, cfg.SFTPConfig.DownloadPath)
+	filesArchivedTotal.WithLabelValues(t.job.Name).Inc()
+	return nil
+}
 
-	if err != nil {
-		iLog.Fatalf("Failed downloading files. Err: %s\n", err)
+// pooledSession is a cached *sftp.Client together with the semaphore slot
+// it holds for as long as it stays open, so the slot is only freed when the
+// session itself is closed.
+type pooledSession struct {
+	sc  *sftp.Client
+	sem chan struct{}
+}
+
+// connPool keeps a single *ssh.Client per host address so that jobs sharing
+// a host reuse the same connection, and caches one *sftp.Client session per
+// job on top of it, reused across every call for that job's lifetime
+// instead of dialing a new session each time. Each cached session holds a
+// semaphore slot on its host for as long as it stays open, so the slot
+// count for a host is sized to at least the number of jobs configured
+// against it: otherwise a host with more jobs than max_sessions_per_conn
+// would leave the extra jobs blocked forever waiting for a slot that's
+// never released short of process exit.
+type connPool struct {
+	mu           sync.Mutex
+	clients      map[string]*ssh.Client
+	sems         map[string]chan struct{}
+	sessions     map[string]*pooledSession
+	sessionLocks map[string]*sync.Mutex
+	jobsPerAddr  map[string]int
+}
+
+// newConnPool precomputes, for every job whose connection string resolves
+// cleanly, how many jobs share its host address — used to size each host's
+// session semaphore so a cached-session-per-job host never deadlocks a job
+// waiting on a slot that nothing will ever release. A job whose connection
+// string can't be resolved yet is simply not counted; it will fail with a
+// proper error from dial when it's actually used.
+func newConnPool(jobs []Job) *connPool {
+	jobsPerAddr := make(map[string]int)
+	for _, job := range jobs {
+		if addr, _, _, _, err := resolveConnInfo(job); err == nil {
+			jobsPerAddr[addr]++
+		}
 	}
-	if verbose {
-		iLog.Println("VERBOSE: finished download")
+	return &connPool{
+		clients:      make(map[string]*ssh.Client),
+		sems:         make(map[string]chan struct{}),
+		sessions:     make(map[string]*pooledSession),
+		sessionLocks: make(map[string]*sync.Mutex),
+		jobsPerAddr:  jobsPerAddr,
 	}
-	duration := time.Since(start)
-	iLog.Printf("Successfully downlaoded %v files. Took %s\n", len(filesToDownload), duration)
 }
 
-func readConfigFile(config *Config, configPath string) error {
-	if verbose {
-		iLog.Println("VERBOSE: reading config file")
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		s.sc.Close()
+		<-s.sem
 	}
-	f, err := os.Open(configPath)
-	if err != nil {
-		return err
+	for _, c := range p.clients {
+		c.Close()
 	}
-	defer f.Close()
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(&config)
+}
+
+// sftpClient returns job's cached sftp.Client session, opening one the
+// first time job is seen (dialing a new ssh.Client the first time its host
+// is seen) and reusing it on every subsequent call, so repeated calls
+// across a long-running daemon don't each leak a new session. Concurrent
+// callers for the same job (e.g. a watch poll tick racing a scheduled run)
+// serialize on jobLock instead of each dialing their own session, so only
+// one session and semaphore slot is ever created per job.
+func (p *connPool) sftpClient(job Job) (*sftp.Client, error) {
+	lock := p.jobLock(job.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.mu.Lock()
+	if s, ok := p.sessions[job.Name]; ok {
+		p.mu.Unlock()
+		return s.sc, nil
+	}
+	p.mu.Unlock()
+
+	client, sem, err := p.dial(job)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if verbose {
-		iLog.Println("VERBOSE: finished reading config file")
+
+	sem <- struct{}{}
+	sc, err := sftp.NewClient(client, sftp.MaxConcurrentRequestsPerFile(job.downloadOptions().workers))
+	if err != nil {
+		<-sem
+		return nil, fmt.Errorf("unable to start SFTP subsystem: %v", err)
 	}
-	return nil
+
+	p.mu.Lock()
+	p.sessions[job.Name] = &pooledSession{sc: sc, sem: sem}
+	p.mu.Unlock()
+	return sc, nil
 }
 
-// list files in the SFTP folder
-func listSFTPFiles(sc sftp.Client, remoteDir string) (SFTPList []fs.FileInfo, err error) {
-	files, err := sc.ReadDir(remoteDir)
+// jobLock returns the mutex that serializes session creation for jobName,
+// creating it the first time jobName is seen.
+func (p *connPool) jobLock(jobName string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lock, ok := p.sessionLocks[jobName]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.sessionLocks[jobName] = lock
+	}
+	return lock
+}
+
+// resolveConnInfo parses job's connection string env var into the address
+// to dial and the credentials embedded in its userinfo.
+func resolveConnInfo(job Job) (addr, user, password string, passwordExists bool, err error) {
+	rawurl := os.Getenv(job.ConnectionStringEnvVar)
+	if rawurl == "" {
+		return "", "", "", false, fmt.Errorf("can't find environment variable %s", job.ConnectionStringEnvVar)
+	}
+
+	parsedURL, err := url.Parse(rawurl)
 	if err != nil {
-		return nil, err
+		return "", "", "", false, fmt.Errorf("parse url error: %v", err)
 	}
-	// ignoring directories
-	for i, file := range files {
-		if file.IsDir() {
-			iLog.Printf("VERBOSE: Removing directory from list %s\n", file.Name())
-			files = remove(files, i)
-		}
+
+	user = parsedURL.User.Username()
+	password, passwordExists = parsedURL.User.Password()
+	host := parsedURL.Hostname()
+	port := parsedURL.Port()
+	if port == "" {
+		port = defaultSFTPPort
 	}
-	return files, nil
+	return net.JoinHostPort(host, port), user, password, passwordExists, nil
 }
 
-func remove(files []fs.FileInfo, i int) []fs.FileInfo {
-	return append(files[:i], files[i+1:]...)
-}
+func (p *connPool) dial(job Job) (*ssh.Client, chan struct{}, error) {
+	addr, user, password, passwordExists, err := resolveConnInfo(job)
+	if err != nil {
+		return nil, nil, err
+	}
 
-// compare files in two directories
-func getDiffFileNames(processedSFTPFiles, archivedSFTPFiles []fs.FileInfo) []string {
-	archived := make(map[string]struct{}, len(archivedSFTPFiles))
-	for _, af := range archivedSFTPFiles {
-		archived[af.Name()] = struct{}{}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[addr]; ok {
+		return client, p.sems[addr], nil
 	}
-	var diff []string
-	for _, nf := range processedSFTPFiles {
-		if _, found := archived[nf.Name()]; !found {
-			diff = append(diff, nf.Name())
-		}
+
+	auths, err := buildAuthMethods(job, password, passwordExists)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure SSH auth: %v", err)
 	}
-	if verbose {
-		iLog.Println("VERBOSE: finished getting diff files")
+	hostKeyCallback, err := buildHostKeyCallback(job)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure host key verification: %v", err)
+	}
+	config := ssh.ClientConfig{
+		User:            user,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+	}
+	conn, err := ssh.Dial("tcp", addr, &config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connecto to [%s]: %v", addr, err)
 	}
 
-	return diff
+	maxSessions := job.MaxSessionsPerConn
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxSessionsPerConn
+	}
+	if jobs := p.jobsPerAddr[addr]; jobs > maxSessions {
+		logger.Warn("max_sessions_per_conn is smaller than the number of jobs sharing this host, raising it so no job blocks forever", "host", addr, "max_sessions_per_conn", maxSessions, "jobs", jobs)
+		maxSessions = jobs
+	}
+	p.clients[addr] = conn
+	p.sems[addr] = make(chan struct{}, maxSessions)
+	return conn, p.sems[addr], nil
 }
 
-func downloadFiles(sc sftp.Client, files []string, remoteReadPath, remoteArchivePath, downloadPath string) (err error) {
-	for i, fileName := range files {
-		iLog.Printf("Working on file %d of %d", i+1, len(files))
-		err = downloadRemoteFile(sc, fmt.Sprintf("%s/%s", remoteReadPath, fileName), fmt.Sprintf("%s/%s", downloadPath, fileName))
+// buildAuthMethods resolves the configured auth.method (password, key or
+// agent) into the ssh.AuthMethod list used to dial the server. It defaults
+// to password auth for backwards compatibility with existing configs.
+func buildAuthMethods(job Job, password string, passwordExists bool) ([]ssh.AuthMethod, error) {
+	method := job.Auth.Method
+	if method == "" {
+		method = "password"
+	}
+
+	switch method {
+	case "password":
+		if !passwordExists {
+			return nil, fmt.Errorf("missing password in connection string env var")
+		}
+		return []ssh.AuthMethod{ssh.Password(password)}, nil
+	case "key":
+		keyFile := job.Auth.KeyFile
+		if keyFile == "" {
+			return nil, fmt.Errorf("auth.keyfile is required for auth.method \"key\"")
+		}
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read keyfile %s: %v", keyFile, err)
+		}
+		var signer ssh.Signer
+		if envVar := job.Auth.KeyPassphraseEnvVar; envVar != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(os.Getenv(envVar)))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to parse private key %s: %v", keyFile, err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	case "agent":
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, cannot use auth.method \"agent\"")
 		}
-		err = archiveRemoteFile(sc, fmt.Sprintf("%s/%s", remoteArchivePath, fileName), fmt.Sprintf("%s/%s", remoteReadPath, fileName))
+		conn, err := net.Dial("unix", sock)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to connect to ssh-agent at %s: %v", sock, err)
 		}
+		agentClient := agent.NewClient(conn)
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agentClient.Signers)}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth.method %q", method)
 	}
-	return
 }
 
-// Download file from sftp server
-func downloadRemoteFile(sc sftp.Client, remoteReadFile, localFile string) (err error) {
-
-	//  Open file in sftp server
-	srcFile, err := sc.OpenFile(remoteReadFile, (os.O_RDONLY))
-	if err != nil {
-		return fmt.Errorf("Unable to open remote file: %v\n", err)
-
+// buildHostKeyCallback builds the ssh.HostKeyCallback used to verify the
+// remote host key against known_hosts_path. known_hosts_path defaults to
+// ~/.ssh/known_hosts when unset, so the out-of-the-box behavior verifies
+// against whatever hosts the operator has already connected to instead of
+// silently trusting anyone. When the (explicit or default) known_hosts_path
+// can't be loaded, it falls back to permissive (insecure) checking unless
+// strict_host_key_checking is enabled, in which case it returns an error
+// instead of silently accepting unknown hosts.
+func buildHostKeyCallback(job Job) (ssh.HostKeyCallback, error) {
+	strict := job.StrictHostKeyChecking
+	path := job.KnownHostsPath
+
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".ssh", "known_hosts")
+		} else if strict {
+			return nil, fmt.Errorf("known_hosts_path is required when strict_host_key_checking is enabled")
+		} else {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
 	}
-	defer srcFile.Close()
 
-	// create local file
-	dstLocalFile, err := os.Create(localFile)
+	callback, err := knownhosts.New(path)
 	if err != nil {
-		return fmt.Errorf("Unable to open local file: %v\n", err)
-
+		if strict {
+			return nil, fmt.Errorf("unable to load known_hosts_path %s: %v", path, err)
+		}
+		logger.Warn("unable to load known_hosts_path, falling back to insecure host key checking", "path", path, "error", err)
+		return ssh.InsecureIgnoreHostKey(), nil
 	}
-	defer dstLocalFile.Close()
+	return callback, nil
+}
 
-	// copy file from sftp to localfile
-	_, err = io.Copy(dstLocalFile, srcFile)
+// list files in the SFTP folder
+func listSFTPFiles(sc sftp.Client, remoteDir string) (SFTPList []fs.FileInfo, err error) {
+	files, err := sc.ReadDir(remoteDir)
 	if err != nil {
-		return fmt.Errorf("Unable to copy remote file: %v\n", err)
+		return nil, err
 	}
-
-	if verbose {
-		iLog.Printf("VERBOSE: finished processing file %v\n", localFile)
+	// ignoring directories
+	SFTPList = make([]fs.FileInfo, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			logger.Debug("skipping directory", "name", file.Name())
+			continue
+		}
+		SFTPList = append(SFTPList, file)
 	}
-	return
+	return SFTPList, nil
 }
 
 // Archive file in sftp server
@@ -273,8 +715,6 @@ func archiveRemoteFile(sc sftp.Client, remoteArchiveFile, remoteReadName string)
 	if err != nil {
 		return fmt.Errorf("Unable to move remote file: %v\n", err)
 	}
-	if verbose {
-		iLog.Printf("VERBOSE: finished moving file %v\n", remoteReadName)
-	}
+	logger.Debug("archived remote file", "remote_path", remoteReadName)
 	return
 }
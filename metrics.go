@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsConfig controls the opt-in /metrics HTTP endpoint. Leaving
+// ListenAddr empty (the default) disables it entirely.
+type MetricsConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+}
+
+var (
+	filesListedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosftpsync_files_listed_total",
+		Help: "Remote files seen while listing a job's read path.",
+	}, []string{"job"})
+
+	filesDownloadedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosftpsync_files_downloaded_total",
+		Help: "Files successfully downloaded.",
+	}, []string{"job"})
+
+	filesFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosftpsync_files_failed_total",
+		Help: "Files that failed to sync.",
+	}, []string{"job"})
+
+	filesArchivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gosftpsync_files_archived_total",
+		Help: "Files successfully archived on the remote after downloading.",
+	}, []string{"job"})
+
+	downloadDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gosftpsync_download_duration_seconds",
+		Help:    "Per-file download duration in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"job"})
+
+	downloadSizeBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gosftpsync_download_size_bytes",
+		Help:    "Per-file download size in bytes.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"job"})
+
+	lastSuccessfulRunTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gosftpsync_last_successful_run_timestamp_seconds",
+		Help: "Unix timestamp of the last run that completed for a job without error.",
+	}, []string{"job"})
+)
+
+// serveMetrics starts an HTTP server exposing Prometheus metrics on
+// addr/metrics in the background. It does not block main: a failure to
+// bind is logged, not fatal, since metrics are an optional operational
+// aid rather than something the sync itself depends on.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		logger.Info("serving prometheus metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("metrics server stopped", "error", err)
+		}
+	}()
+}
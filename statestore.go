@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileRecord is what the state store remembers about a file that has
+// already been synced: enough to detect that the remote copy changed
+// without re-downloading it just to check.
+type FileRecord struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// stateStore is a small JSON-file-backed record of every file a job has
+// downloaded, keyed by name. It replaces the old "does it exist in the
+// archived dir" heuristic, so jobs that cannot rename files on a read-only
+// SFTP drop can still sync idempotently.
+type stateStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]FileRecord
+}
+
+// openStateStore loads path if it exists, or starts an empty store if it
+// doesn't.
+func openStateStore(path string) (*stateStore, error) {
+	store := &stateStore{path: path, records: make(map[string]FileRecord)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("unable to read state store %s: %v", path, err)
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+	if err := json.Unmarshal(data, &store.records); err != nil {
+		return nil, fmt.Errorf("unable to parse state store %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// needsDownload reports whether name is missing from the store or its
+// recorded size/mtime no longer matches the remote file.
+func (s *stateStore) needsDownload(name string, size int64, modTime time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[name]
+	if !ok {
+		return true
+	}
+	return record.Size != size || !record.ModTime.Equal(modTime)
+}
+
+// put records a downloaded file and persists the store to disk.
+func (s *stateStore) put(record FileRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.Name] = record
+
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode state store: %v", err)
+	}
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("unable to create state store directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("unable to write state store %s: %v", s.path, err)
+	}
+	return nil
+}
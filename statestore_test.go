@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStoreNeedsDownload(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store, err := openStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("openStateStore: %v", err)
+	}
+
+	if !store.needsDownload("a.txt", 10, now) {
+		t.Fatal("expected unseen file to need download")
+	}
+
+	if err := store.put(FileRecord{Name: "a.txt", Size: 10, ModTime: now, SHA256: "deadbeef"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		fileName string
+		size     int64
+		modTime  time.Time
+		want     bool
+	}{
+		{"unchanged file is up to date", "a.txt", 10, now, false},
+		{"size changed", "a.txt", 11, now, true},
+		{"mtime changed", "a.txt", 10, now.Add(time.Second), true},
+		{"still unseen file needs download", "b.txt", 5, now, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := store.needsDownload(tt.fileName, tt.size, tt.modTime); got != tt.want {
+				t.Errorf("needsDownload(%q, %d, %v) = %v, want %v", tt.fileName, tt.size, tt.modTime, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateStorePutPersists(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatalf("openStateStore: %v", err)
+	}
+	if err := store.put(FileRecord{Name: "a.txt", Size: 10, ModTime: now, SHA256: "deadbeef"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	reloaded, err := openStateStore(path)
+	if err != nil {
+		t.Fatalf("reopen openStateStore: %v", err)
+	}
+	if reloaded.needsDownload("a.txt", 10, now) {
+		t.Fatal("expected record to survive reload")
+	}
+	if !reloaded.needsDownload("a.txt", 11, now) {
+		t.Fatal("expected reloaded record to still detect a size change")
+	}
+}